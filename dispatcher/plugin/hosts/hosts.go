@@ -18,17 +18,29 @@
 package hosts
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/dispatcher/handler"
 	"github.com/IrineSistiana/mosdns/dispatcher/matcher/domain"
+	"github.com/IrineSistiana/mosdns/dispatcher/utils"
+	"github.com/fsnotify/fsnotify"
 	"github.com/miekg/dns"
+	"go.uber.org/zap"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const PluginType = "hosts"
 
+// defaultTTL is used for records that don't specify their own ttl= option.
+const defaultTTL = 3600
+
 func init() {
 	handler.RegInitFunc(PluginType, Init, func() interface{} { return new(Args) })
 }
@@ -38,12 +50,35 @@ var _ handler.ContextPlugin = (*hostsContainer)(nil)
 
 type Args struct {
 	Hosts []string `yaml:"hosts"`
+	// TTL is the default ttl used for records that don't set their own
+	// ttl= option. If it's <= 0, defaultTTL is used.
+	TTL int `yaml:"ttl"`
+}
+
+// reverseEntry is one PTR-able record: the fqdn a reverse lookup should
+// return for a given IP, and the ttl its *ipRecord carried (0 means "use the
+// plugin default", same convention as ipRecord.ttl).
+type reverseEntry struct {
+	fqdn string
+	ttl  uint32
+}
+
+// hostsData is the reloadable snapshot of a hostsContainer: the forward
+// domain matcher plus the IP -> fqdn reverse index used for PTR queries.
+// It's swapped in atomically on reload so readers never see a half-built
+// state.
+type hostsData struct {
+	matcher domain.Matcher
+	ptr     map[string]*reverseEntry // keyed by net.IP.String()
 }
 
 type hostsContainer struct {
 	*handler.BP
 
-	matcher domain.Matcher
+	defaultTTL uint32
+	data       atomic.Value // *hostsData
+
+	watcher *fsnotify.Watcher
 }
 
 func Init(bp *handler.BP, args interface{}) (p handler.Plugin, err error) {
@@ -63,16 +98,97 @@ func newHostsContainer(bp *handler.BP, args *Args) (*hostsContainer, error) {
 		return nil, errors.New("no hosts file is configured")
 	}
 
+	ttl := uint32(defaultTTL)
+	if args.TTL > 0 {
+		ttl = uint32(args.TTL)
+	}
+
+	h := &hostsContainer{
+		BP:         bp,
+		defaultTTL: ttl,
+	}
+
+	data, err := h.load(args.Hosts)
+	if err != nil {
+		return nil, err
+	}
+	h.data.Store(data)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		// Hot reload is a bonus, not a requirement: log and carry on without it.
+		h.L().Warn("fsnotify watcher unavailable, hosts hot reload disabled", zap.Error(err))
+	} else {
+		for _, f := range args.Hosts {
+			if err := watcher.Add(f); err != nil {
+				h.L().Warn("failed to watch hosts file", zap.Error(err))
+			}
+		}
+		h.watcher = watcher
+		go h.watchLoop(args.Hosts)
+	}
+
+	return h, nil
+}
+
+// load builds a fresh *hostsData from the given hosts files.
+func (h *hostsContainer) load(files []string) (*hostsData, error) {
 	mixMatcher := domain.NewMixMatcher()
 	mixMatcher.SetPattenTypeMap(patternTypeMap)
-	err := domain.BatchLoadMatcher(mixMatcher, args.Hosts, parseIP)
-	if err != nil {
+	if err := domain.BatchLoadMatcher(mixMatcher, files, parseIP); err != nil {
 		return nil, err
 	}
-	return &hostsContainer{
-		BP:      bp,
-		matcher: mixMatcher,
-	}, nil
+
+	ptr := make(map[string]*reverseEntry)
+	for _, f := range files {
+		if err := indexReverseEntries(f, ptr); err != nil {
+			return nil, fmt.Errorf("failed to build reverse index from %s: %w", f, err)
+		}
+	}
+
+	return &hostsData{matcher: mixMatcher, ptr: ptr}, nil
+}
+
+// watchLoop reloads the hosts data whenever one of the watched files changes.
+func (h *hostsContainer) watchLoop(files []string) {
+	for {
+		select {
+		case event, ok := <-h.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				// fsnotify/inotify watches the inode, not the path: once the
+				// inode at event.Name is removed or renamed away, the watch
+				// on it is gone even though the path itself lives on - the
+				// write-to-temp-then-rename pattern most editors and config
+				// tools use. Re-arm the watch on whatever now occupies the
+				// path so reload keeps working past the first edit.
+				if err := h.watcher.Add(event.Name); err != nil {
+					h.L().Warn("failed to re-watch hosts file", zap.String("file", event.Name), zap.Error(err))
+				}
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+				continue
+			}
+			data, err := h.load(files)
+			if err != nil {
+				h.L().Warn("failed to reload hosts files", zap.Error(err))
+				continue
+			}
+			h.data.Store(data)
+			h.L().Info("hosts files reloaded")
+		case err, ok := <-h.watcher.Errors:
+			if !ok {
+				return
+			}
+			h.L().Warn("hosts watcher error", zap.Error(err))
+		}
+	}
+}
+
+func (h *hostsContainer) current() *hostsData {
+	return h.data.Load().(*hostsData)
 }
 
 func (h *hostsContainer) ExecES(ctx context.Context, qCtx *handler.Context) (earlyStop bool, err error) {
@@ -87,87 +203,297 @@ func (h *hostsContainer) Connect(ctx context.Context, qCtx *handler.Context, pip
 }
 
 func (h *hostsContainer) matchAndSet(qCtx *handler.Context) (matched bool) {
+	start := time.Now()
+	defer func() {
+		utils.ObservePluginMetrics(h.Tag(), time.Since(start).Seconds())
+	}()
+
 	if len(qCtx.Q().Question) != 1 {
 		return false
 	}
 
-	typ := qCtx.Q().Question[0].Qtype
-	fqdn := qCtx.Q().Question[0].Name
-	v, ok := h.matcher.Match(fqdn)
+	q := qCtx.Q().Question[0]
+	data := h.current()
+
+	switch q.Qtype {
+	case dns.TypePTR:
+		return h.matchPTR(qCtx, data, q.Name)
+	case dns.TypeA, dns.TypeAAAA:
+		return h.matchForward(qCtx, data, q.Name, q.Qtype)
+	default:
+		return false
+	}
+}
+
+func (h *hostsContainer) matchForward(qCtx *handler.Context, data *hostsData, fqdn string, typ uint16) bool {
+	record, ok := h.lookup(data, fqdn)
 	if !ok {
 		return false
 	}
-	record := v.(*ipRecord)
 
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+
+	if len(record.cname) > 0 {
+		r.Answer = append(r.Answer, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: fqdn, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: h.ttl(record)},
+			Target: dns.Fqdn(record.cname),
+		})
+		// Chase the CNAME target locally: if it also has a hosts entry,
+		// append its A/AAAA records to the same response.
+		if target, ok := h.lookup(data, dns.Fqdn(record.cname)); ok {
+			appendAddrRecords(r, dns.Fqdn(record.cname), typ, target, h.ttl(target))
+		}
+		qCtx.SetResponse(r, handler.ContextStatusResponded)
+		return true
+	}
+
+	if !appendAddrRecords(r, fqdn, typ, record, h.ttl(record)) {
+		return false
+	}
+	qCtx.SetResponse(r, handler.ContextStatusResponded)
+	return true
+}
+
+// lookup returns the *ipRecord the matcher holds for fqdn. It does not chase
+// CNAMEs itself; matchForward follows a record's cname one step.
+func (h *hostsContainer) lookup(data *hostsData, fqdn string) (*ipRecord, bool) {
+	v, ok := data.matcher.Match(fqdn)
+	if !ok {
+		return nil, false
+	}
+	return v.(*ipRecord), true
+}
+
+func appendAddrRecords(r *dns.Msg, fqdn string, typ uint16, record *ipRecord, ttl uint32) bool {
 	switch typ {
 	case dns.TypeA:
-		if len(record.ipv4) != 0 {
-			r := new(dns.Msg)
-			r.SetReply(qCtx.Q())
-			for _, ip := range record.ipv4 {
-				ipCopy := make(net.IP, len(ip))
-				copy(ipCopy, ip)
-				rr := &dns.A{
-					Hdr: dns.RR_Header{
-						Name:   fqdn,
-						Rrtype: dns.TypeA,
-						Class:  dns.ClassINET,
-						Ttl:    3600,
-					},
-					A: ipCopy,
-				}
-				r.Answer = append(r.Answer, rr)
-			}
-			qCtx.SetResponse(r, handler.ContextStatusResponded)
-			return true
+		if len(record.ipv4) == 0 {
+			return false
 		}
-
+		for _, ip := range record.ipv4 {
+			ipCopy := make(net.IP, len(ip))
+			copy(ipCopy, ip)
+			r.Answer = append(r.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+				A:   ipCopy,
+			})
+		}
+		return true
 	case dns.TypeAAAA:
-		if len(record.ipv6) != 0 {
-			r := new(dns.Msg)
-			r.SetReply(qCtx.Q())
-			for _, ip := range record.ipv6 {
-				ipCopy := make(net.IP, len(ip))
-				copy(ipCopy, ip)
-				rr := &dns.AAAA{
-					Hdr: dns.RR_Header{
-						Name:   fqdn,
-						Rrtype: dns.TypeAAAA,
-						Class:  dns.ClassINET,
-						Ttl:    3600,
-					},
-					AAAA: ipCopy,
-				}
-				r.Answer = append(r.Answer, rr)
-			}
-			qCtx.SetResponse(r, handler.ContextStatusResponded)
-			return true
+		if len(record.ipv6) == 0 {
+			return false
+		}
+		for _, ip := range record.ipv6 {
+			ipCopy := make(net.IP, len(ip))
+			copy(ipCopy, ip)
+			r.Answer = append(r.Answer, &dns.AAAA{
+				Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+				AAAA: ipCopy,
+			})
 		}
+		return true
 	}
 	return false
 }
 
+func (h *hostsContainer) matchPTR(qCtx *handler.Context, data *hostsData, qname string) bool {
+	ip, err := ptrNameToIP(qname)
+	if err != nil {
+		return false
+	}
+
+	entry, ok := data.ptr[ip.String()]
+	if !ok {
+		return false
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	r.Answer = append(r.Answer, &dns.PTR{
+		Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: h.reverseTTL(entry)},
+		Ptr: dns.Fqdn(entry.fqdn),
+	})
+	qCtx.SetResponse(r, handler.ContextStatusResponded)
+	return true
+}
+
+// reverseTTL returns e's own ttl override, falling back to the plugin-wide
+// default, mirroring (*hostsContainer).ttl for forward records.
+func (h *hostsContainer) reverseTTL(e *reverseEntry) uint32 {
+	if e.ttl > 0 {
+		return e.ttl
+	}
+	return h.defaultTTL
+}
+
+// ptrNameToIP reverses a "x.x.x.x.in-addr.arpa." / "...ip6.arpa." PTR
+// question name back into the net.IP it represents.
+func ptrNameToIP(qname string) (net.IP, error) {
+	arpa := strings.TrimSuffix(dns.Fqdn(qname), ".")
+	return reverseAddrToIP(arpa)
+}
+
+// reverseAddrToIP parses the reversed-nibble/octet labels of an
+// in-addr.arpa or ip6.arpa name back into a net.IP.
+func reverseAddrToIP(arpa string) (net.IP, error) {
+	switch {
+	case strings.HasSuffix(arpa, ".in-addr.arpa"):
+		labels := strings.Split(strings.TrimSuffix(arpa, ".in-addr.arpa"), ".")
+		if len(labels) != 4 {
+			return nil, fmt.Errorf("malformed in-addr.arpa name %s", arpa)
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		ip := net.ParseIP(strings.Join(labels, "."))
+		if ip == nil {
+			return nil, fmt.Errorf("malformed in-addr.arpa name %s", arpa)
+		}
+		return ip, nil
+
+	case strings.HasSuffix(arpa, ".ip6.arpa"):
+		labels := strings.Split(strings.TrimSuffix(arpa, ".ip6.arpa"), ".")
+		if len(labels) != 32 {
+			return nil, fmt.Errorf("malformed ip6.arpa name %s", arpa)
+		}
+		var sb strings.Builder
+		for i := len(labels) - 1; i >= 0; i-- {
+			sb.WriteString(labels[i])
+			if i != 0 && (len(labels)-i)%4 == 0 {
+				sb.WriteByte(':')
+			}
+		}
+		ip := net.ParseIP(sb.String())
+		if ip == nil {
+			return nil, fmt.Errorf("malformed ip6.arpa name %s", arpa)
+		}
+		return ip, nil
+	}
+	return nil, fmt.Errorf("%s is not a PTR name", arpa)
+}
+
+// indexReverseEntries scans a hosts file a second time to build the IP ->
+// fqdn reverse map. domain.BatchLoadMatcher's parse callback never sees the
+// fqdn a line's values belong to (only the value tokens), so pairing an
+// *ipRecord back up with its fqdn unavoidably means reading the file again;
+// what it must NOT do is re-derive that *ipRecord with its own option
+// parsing. So each line's value tokens are run through the same parseIP the
+// forward matcher uses, and addReverseEntries fans the result's ttl out to
+// every IP it covers - one parser, two indexes built from its output.
+func indexReverseEntries(path string, ptr map[string]*reverseEntry) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = strings.TrimSpace(line[:idx])
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		v, accept, err := parseIP(fields[1:])
+		if err != nil {
+			return fmt.Errorf("invalid record for %s: %w", fields[0], err)
+		}
+		if !accept {
+			continue
+		}
+		addReverseEntries(ptr, fields[0], v.(*ipRecord))
+	}
+	return scanner.Err()
+}
+
+// addReverseEntries adds a ptr entry for every IP in record, pointing back
+// at fqdn with record's ttl. The first fqdn seen for a given IP wins,
+// matching standard /etc/hosts PTR semantics.
+func addReverseEntries(ptr map[string]*reverseEntry, fqdn string, record *ipRecord) {
+	for _, ip := range record.ipv4 {
+		addReverseEntry(ptr, ip, fqdn, record.ttl)
+	}
+	for _, ip := range record.ipv6 {
+		addReverseEntry(ptr, ip, fqdn, record.ttl)
+	}
+}
+
+func addReverseEntry(ptr map[string]*reverseEntry, ip net.IP, fqdn string, ttl uint32) {
+	key := ip.String()
+	if _, exists := ptr[key]; !exists {
+		ptr[key] = &reverseEntry{fqdn: fqdn, ttl: ttl}
+	}
+}
+
 type ipRecord struct {
-	ipv4 []net.IP
-	ipv6 []net.IP
+	ipv4  []net.IP
+	ipv6  []net.IP
+	cname string
+	ttl   uint32 // 0 means "use the plugin default"
+}
+
+func (h *hostsContainer) ttl(r *ipRecord) uint32 {
+	if r.ttl > 0 {
+		return r.ttl
+	}
+	return h.defaultTTL
 }
 
 func (r *ipRecord) Append(v interface{}) {
 	n := v.(*ipRecord)
 	r.ipv4 = append(r.ipv4, n.ipv4...)
 	r.ipv6 = append(r.ipv6, n.ipv6...)
+	if len(n.cname) > 0 {
+		r.cname = n.cname
+	}
+	if n.ttl > 0 {
+		r.ttl = n.ttl
+	}
 }
 
+// parseIP turns the value tokens of a hosts line into an *ipRecord. In
+// addition to plain IPv4/IPv6 addresses, it accepts two options anywhere in
+// the token list:
+//   - "cname <target>": the entry resolves to a CNAME pointing at target.
+//   - "ttl=<seconds>": overrides the plugin-wide default TTL for this entry.
 func parseIP(s []string) (v interface{}, accept bool, err error) {
 	if len(s) == 0 {
 		return nil, false, nil
 	}
 
 	record := new(ipRecord)
-	for _, ipStr := range s {
-		ip := net.ParseIP(ipStr)
+	for i := 0; i < len(s); i++ {
+		tok := s[i]
+
+		switch {
+		case tok == "cname":
+			if i+1 >= len(s) {
+				return nil, false, errors.New("cname option is missing its target")
+			}
+			record.cname = s[i+1]
+			i++
+			continue
+
+		case strings.HasPrefix(tok, "ttl="):
+			n, err := strconv.ParseUint(strings.TrimPrefix(tok, "ttl="), 10, 32)
+			if err != nil {
+				return nil, false, fmt.Errorf("invalid ttl option %s: %w", tok, err)
+			}
+			record.ttl = uint32(n)
+			continue
+		}
+
+		ip := net.ParseIP(tok)
 		if ip == nil {
-			return nil, false, fmt.Errorf("invalid ip addr %s", ipStr)
+			return nil, false, fmt.Errorf("invalid ip addr %s", tok)
 		}
 
 		if ipv4 := ip.To4(); ipv4 != nil { // is ipv4
@@ -175,8 +501,12 @@ func parseIP(s []string) (v interface{}, accept bool, err error) {
 		} else if ipv6 := ip.To16(); ipv6 != nil { // is ipv6
 			record.ipv6 = append(record.ipv6, ipv6)
 		} else { // invalid
-			return nil, false, fmt.Errorf("%s is not an ipv4 or ipv6 addr", ipStr)
+			return nil, false, fmt.Errorf("%s is not an ipv4 or ipv6 addr", tok)
 		}
 	}
+
+	if len(record.ipv4) == 0 && len(record.ipv6) == 0 && len(record.cname) == 0 {
+		return nil, false, nil
+	}
 	return record, true, nil
 }
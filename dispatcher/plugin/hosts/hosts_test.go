@@ -0,0 +1,173 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package hosts
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/dispatcher/handler"
+	"github.com/miekg/dns"
+)
+
+func writeHostsFile(t *testing.T, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	p := filepath.Join(dir, "hosts")
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write test hosts file: %v", err)
+	}
+	return p
+}
+
+func newQuery(name string, qtype uint16) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), qtype)
+	return q
+}
+
+func TestHostsContainer_PTRSynthesis(t *testing.T) {
+	path := writeHostsFile(t, "host.example 192.0.2.1\n")
+	h := &hostsContainer{defaultTTL: defaultTTL}
+	data, err := h.load([]string{path})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	h.data.Store(data)
+
+	qCtx := handler.NewContext(newQuery("1.2.0.192.in-addr.arpa", dns.TypePTR), net.ParseIP("127.0.0.1"))
+	if !h.matchPTR(qCtx, data, dns.Fqdn("1.2.0.192.in-addr.arpa")) {
+		t.Fatalf("expected PTR match")
+	}
+	r := qCtx.R()
+	if len(r.Answer) != 1 {
+		t.Fatalf("expected 1 answer, got %d", len(r.Answer))
+	}
+	ptr, ok := r.Answer[0].(*dns.PTR)
+	if !ok {
+		t.Fatalf("expected *dns.PTR answer, got %T", r.Answer[0])
+	}
+	if ptr.Ptr != dns.Fqdn("host.example") {
+		t.Errorf("ptr = %s, want %s", ptr.Ptr, dns.Fqdn("host.example"))
+	}
+	if ptr.Hdr.Ttl != defaultTTL {
+		t.Errorf("ttl = %d, want default %d", ptr.Hdr.Ttl, defaultTTL)
+	}
+}
+
+func TestHostsContainer_CNAMEChase(t *testing.T) {
+	path := writeHostsFile(t, "alias.example cname target.example\ntarget.example 192.0.2.2\n")
+	h := &hostsContainer{defaultTTL: defaultTTL}
+	data, err := h.load([]string{path})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	h.data.Store(data)
+
+	qCtx := handler.NewContext(newQuery("alias.example", dns.TypeA), net.ParseIP("127.0.0.1"))
+	if !h.matchForward(qCtx, data, dns.Fqdn("alias.example"), dns.TypeA) {
+		t.Fatalf("expected forward match")
+	}
+	r := qCtx.R()
+	if len(r.Answer) != 2 {
+		t.Fatalf("expected cname + a record, got %d answers", len(r.Answer))
+	}
+	if _, ok := r.Answer[0].(*dns.CNAME); !ok {
+		t.Errorf("answer[0] = %T, want *dns.CNAME", r.Answer[0])
+	}
+	a, ok := r.Answer[1].(*dns.A)
+	if !ok {
+		t.Fatalf("answer[1] = %T, want *dns.A", r.Answer[1])
+	}
+	if !a.A.Equal(net.ParseIP("192.0.2.2")) {
+		t.Errorf("a = %s, want 192.0.2.2", a.A)
+	}
+}
+
+func TestHostsContainer_TTLOverride(t *testing.T) {
+	path := writeHostsFile(t, "host.example 192.0.2.3 ttl=60\n")
+	h := &hostsContainer{defaultTTL: defaultTTL}
+	data, err := h.load([]string{path})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	h.data.Store(data)
+
+	fwdCtx := handler.NewContext(newQuery("host.example", dns.TypeA), net.ParseIP("127.0.0.1"))
+	if !h.matchForward(fwdCtx, data, dns.Fqdn("host.example"), dns.TypeA) {
+		t.Fatalf("expected forward match")
+	}
+	if got := fwdCtx.R().Answer[0].Header().Ttl; got != 60 {
+		t.Errorf("forward ttl = %d, want 60", got)
+	}
+
+	ptrCtx := handler.NewContext(newQuery("3.2.0.192.in-addr.arpa", dns.TypePTR), net.ParseIP("127.0.0.1"))
+	if !h.matchPTR(ptrCtx, data, dns.Fqdn("3.2.0.192.in-addr.arpa")) {
+		t.Fatalf("expected PTR match")
+	}
+	if got := ptrCtx.R().Answer[0].Header().Ttl; got != 60 {
+		t.Errorf("ptr ttl = %d, want 60 (override should carry over from the forward record)", got)
+	}
+}
+
+func TestHostsContainer_ConcurrentReload(t *testing.T) {
+	path := writeHostsFile(t, "host.example 192.0.2.4\n")
+	h := &hostsContainer{defaultTTL: defaultTTL}
+	data, err := h.load([]string{path})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	h.data.Store(data)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Readers keep hitting h.current() while a writer repeatedly reloads,
+	// simulating watchLoop racing matchAndSet. Run with -race to catch any
+	// unguarded access to the swapped *hostsData.
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					d := h.current()
+					if d == nil {
+						t.Error("current() returned nil")
+					}
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		d, err := h.load([]string{path})
+		if err != nil {
+			t.Fatalf("load: %v", err)
+		}
+		h.data.Store(d)
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,141 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package utils
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterEntry pairs a rate.Limiter with the last time it was touched,
+// so the sweeper can tell which clients have gone idle.
+type rateLimiterEntry struct {
+	limiter    *rate.Limiter
+	lastAccess int64 // unix nano, accessed atomically via ConcurrentMap's TestAndSet
+}
+
+// ClientRateLimiter enforces a queries-per-second budget per client key,
+// using a lazily-created golang.org/x/time/rate.Limiter per key stored in a
+// ConcurrentMap. A background sweeper evicts limiters that have been idle
+// for longer than idleTimeout so memory doesn't grow unbounded with churn
+// through a client population (e.g. CGNAT).
+type ClientRateLimiter struct {
+	qps         float64
+	burst       int
+	idleTimeout time.Duration
+
+	m *ConcurrentMap
+
+	closeOnce sync.Once
+	closeChan chan struct{}
+}
+
+// NewClientRateLimiter creates a ClientRateLimiter that allows qps queries
+// per second per client key, with a token bucket burst of burst. Idle
+// limiters are swept out after idleTimeout.
+func NewClientRateLimiter(qps float64, burst int, idleTimeout time.Duration) *ClientRateLimiter {
+	if idleTimeout <= 0 {
+		idleTimeout = time.Minute * 10
+	}
+
+	l := &ClientRateLimiter{
+		qps:         qps,
+		burst:       burst,
+		idleTimeout: idleTimeout,
+		m:           NewConcurrentMap(64),
+		closeChan:   make(chan struct{}),
+	}
+	go l.sweepLoop()
+	return l
+}
+
+// Allow reports whether a query from key is allowed to proceed right now.
+// It lazily creates a rate.Limiter for key on first use.
+func (l *ClientRateLimiter) Allow(key string) bool {
+	now := time.Now()
+	allowed := false
+
+	l.m.TestAndSet(key, func(v interface{}, ok bool) (newV interface{}, wantUpdate, passed bool) {
+		var entry *rateLimiterEntry
+		if ok {
+			entry = v.(*rateLimiterEntry)
+		} else {
+			entry = &rateLimiterEntry{limiter: rate.NewLimiter(rate.Limit(l.qps), l.burst)}
+		}
+		allowed = entry.limiter.AllowN(now, 1)
+		entry.lastAccess = now.UnixNano()
+		return entry, true, true
+	})
+
+	return allowed
+}
+
+// Close stops the background sweeper. It's safe to call more than once.
+func (l *ClientRateLimiter) Close() {
+	l.closeOnce.Do(func() { close(l.closeChan) })
+}
+
+func (l *ClientRateLimiter) sweepLoop() {
+	ticker := time.NewTicker(l.idleTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.sweep()
+		case <-l.closeChan:
+			return
+		}
+	}
+}
+
+// sweep removes every limiter that hasn't been touched within idleTimeout.
+func (l *ClientRateLimiter) sweep() {
+	cutoff := time.Now().Add(-l.idleTimeout).UnixNano()
+	for _, key := range l.m.Keys() {
+		l.m.TestAndSet(key, func(v interface{}, ok bool) (newV interface{}, wantUpdate, passed bool) {
+			if !ok {
+				return nil, false, false
+			}
+			entry := v.(*rateLimiterEntry)
+			if entry.lastAccess < cutoff {
+				return nil, true, false // delete: wantUpdate with a nil newV removes the key
+			}
+			return entry, false, true
+		})
+	}
+}
+
+// MaskClientKey returns the string form of addr masked to the given IPv4/
+// IPv6 CIDR prefix length, so clients behind a shared CGNAT/carrier range
+// are grouped into a single rate-limiter bucket instead of one each.
+// A prefix <= 0 disables masking for that address family.
+func MaskClientKey(addr net.IP, v4Prefix, v6Prefix int) string {
+	if ip4 := addr.To4(); ip4 != nil {
+		if v4Prefix > 0 && v4Prefix < 32 {
+			return ip4.Mask(net.CIDRMask(v4Prefix, 32)).String()
+		}
+		return ip4.String()
+	}
+	if v6Prefix > 0 && v6Prefix < 128 {
+		return addr.Mask(net.CIDRMask(v6Prefix, 128)).String()
+	}
+	return addr.String()
+}
@@ -0,0 +1,253 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/dispatcher/handler"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
+	"go.uber.org/zap"
+)
+
+const defaultDoHPath = "/dns-query"
+
+// DoHServerConfig configures a DoHServer.
+type DoHServerConfig struct {
+	Logger *zap.Logger
+	// ServerHandler dispatches decoded queries into the normal
+	// entry/ConcurrentLimiter/ClientQueryLimiter pipeline.
+	ServerHandler ServerHandler
+
+	Addr     string
+	Path     string // defaults to "/dns-query"
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile, if set, requires and verifies a client certificate
+	// against the given CA on every connection.
+	ClientCAFile string
+
+	// TrustedProxies, when non-empty, allows the client address to be taken
+	// from the X-Forwarded-For header when the TCP peer address is in this
+	// list. Otherwise X-Forwarded-For is always ignored, so an untrusted
+	// proxy hop can't spoof qCtx.From() and bypass client-based limits.
+	TrustedProxies []*net.IPNet
+}
+
+// DoHServer serves DNS-over-HTTPS (RFC 8484) requests and dispatches them
+// into a ServerHandler, exactly like the UDP/TCP listeners do.
+type DoHServer struct {
+	config *DoHServerConfig
+}
+
+func NewDoHServer(config *DoHServerConfig) *DoHServer {
+	if len(config.Path) == 0 {
+		config.Path = defaultDoHPath
+	}
+	return &DoHServer{config: config}
+}
+
+// ListenAndServe starts the HTTPS (h2/http1.1) listener and, alongside it, an
+// HTTP/3 listener on the same address over QUIC. It blocks serving HTTP/2,
+// returning when that listener errors (e.g. it's closed); the HTTP/3
+// listener runs in the background for as long as the process does and only
+// logs if it exits.
+func (s *DoHServer) ListenAndServe() error {
+	cert, err := tls.LoadX509KeyPair(s.config.CertFile, s.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	// http3.Server manages its own ALPN ("h3") on this TLSConfig, so it gets
+	// its own copy rather than reusing tlsConfig's h2/http1.1 NextProtos.
+	h3TLSConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if len(s.config.ClientCAFile) > 0 {
+		pool, err := loadCertPool(s.config.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to load client ca: %w", err)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		h3TLSConfig.ClientCAs = pool
+		h3TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(s.config.Path, s.handleDoH)
+
+	h3Server := &http3.Server{
+		Addr:      s.config.Addr,
+		TLSConfig: h3TLSConfig,
+		Handler:   mux,
+	}
+	go func() {
+		if err := h3Server.ListenAndServe(); err != nil {
+			s.config.Logger.Warn("doh http/3 listener exited", zap.Error(err))
+		}
+	}()
+
+	httpServer := &http.Server{
+		Addr:      s.config.Addr,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+	return httpServer.ListenAndServeTLS("", "")
+}
+
+func (s *DoHServer) handleDoH(w http.ResponseWriter, req *http.Request) {
+	q, err := readDoHQuery(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	from := s.remoteAddr(req)
+	qCtx := handler.NewContext(q, from)
+	rw := &dohResponseWriter{w: w}
+	s.config.ServerHandler.ServeDNS(req.Context(), qCtx, rw)
+	if !rw.wrote {
+		// ServeDNS silently dropped the query (e.g. ctx done); report a
+		// generic server failure rather than leaving the request hanging.
+		http.Error(w, "no response", http.StatusInternalServerError)
+	}
+}
+
+// readDoHQuery decodes the DNS message out of a GET (base64url `dns=` query
+// param) or POST (application/dns-message body) request, per RFC 8484.
+func readDoHQuery(req *http.Request) (*dns.Msg, error) {
+	var raw []byte
+	switch req.Method {
+	case http.MethodGet:
+		b64 := req.URL.Query().Get("dns")
+		if len(b64) == 0 {
+			return nil, fmt.Errorf("missing dns query param")
+		}
+		b, err := base64.RawURLEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dns query param: %w", err)
+		}
+		raw = b
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != "application/dns-message" {
+			return nil, fmt.Errorf("unsupported content-type %s", req.Header.Get("Content-Type"))
+		}
+		b, err := io.ReadAll(io.LimitReader(req.Body, 65535))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read body: %w", err)
+		}
+		raw = b
+	default:
+		return nil, fmt.Errorf("unsupported method %s", req.Method)
+	}
+
+	q := new(dns.Msg)
+	if err := q.Unpack(raw); err != nil {
+		return nil, fmt.Errorf("invalid dns message: %w", err)
+	}
+	return q, nil
+}
+
+// remoteAddr returns the client IP that should be used for client-based
+// limits: the underlying TCP peer, unless it's in TrustedProxies, in which
+// case X-Forwarded-For is honored.
+func (s *DoHServer) remoteAddr(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	peer := net.ParseIP(host)
+	if peer == nil {
+		return nil
+	}
+
+	if len(s.config.TrustedProxies) == 0 || !ipInNets(peer, s.config.TrustedProxies) {
+		return peer
+	}
+
+	xff := req.Header.Get("X-Forwarded-For")
+	if len(xff) == 0 {
+		return peer
+	}
+	if ip := net.ParseIP(firstForwardedFor(xff)); ip != nil {
+		return ip
+	}
+	return peer
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dohResponseWriter adapts utils.ResponseWriter to a http.ResponseWriter,
+// packing the DNS message as application/dns-message.
+type dohResponseWriter struct {
+	w     http.ResponseWriter
+	wrote bool
+}
+
+func (d *dohResponseWriter) Write(m *dns.Msg) (int, error) {
+	raw, err := m.Pack()
+	if err != nil {
+		return 0, err
+	}
+	d.w.Header().Set("Content-Type", "application/dns-message")
+	d.wrote = true
+	return d.w.Write(raw)
+}
+
+// firstForwardedFor returns the left-most (original client) address out of
+// a comma-separated X-Forwarded-For header value.
+func firstForwardedFor(v string) string {
+	if idx := strings.IndexByte(v, ','); idx >= 0 {
+		v = v[:idx]
+	}
+	return strings.TrimSpace(v)
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	raw, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("no valid certificate found in %s", caFile)
+	}
+	return pool, nil
+}
@@ -0,0 +1,146 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/IrineSistiana/mosdns/dispatcher/handler"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"go.uber.org/zap"
+)
+
+// doqALPN is the ALPN token for DNS-over-QUIC, RFC 9250 section 4.1.1.
+const doqALPN = "doq"
+
+// maxDoQMessageSize bounds how much of a DoQ stream handleStream will buffer
+// before giving up, same limit the DoH POST path applies to its body, so a
+// client that opens a stream and never closes it can't exhaust memory.
+const maxDoQMessageSize = 65535
+
+// DoQServerConfig configures a DoQServer.
+type DoQServerConfig struct {
+	Logger *zap.Logger
+	// ServerHandler dispatches decoded queries into the normal
+	// entry/ConcurrentLimiter/ClientQueryLimiter pipeline.
+	ServerHandler ServerHandler
+
+	Addr     string
+	CertFile string
+	KeyFile  string
+}
+
+// DoQServer serves DNS-over-QUIC (RFC 9250) queries and dispatches them into
+// a ServerHandler, exactly like the UDP/TCP listeners do.
+type DoQServer struct {
+	config *DoQServerConfig
+}
+
+func NewDoQServer(config *DoQServerConfig) *DoQServer {
+	return &DoQServer{config: config}
+}
+
+// ListenAndServe starts the QUIC listener. It blocks until the server
+// returns an error (e.g. the listener is closed).
+func (s *DoQServer) ListenAndServe() error {
+	cert, err := tls.LoadX509KeyPair(s.config.CertFile, s.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{doqALPN},
+	}
+
+	listener, err := quic.ListenAddr(s.config.Addr, tlsConfig, nil)
+	if err != nil {
+		return err
+	}
+
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *DoQServer) handleConn(conn quic.Connection) {
+	from := remoteIP(conn.RemoteAddr())
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return // connection closed
+		}
+		go s.handleStream(stream, from)
+	}
+}
+
+// handleStream reads the single DNS message a DoQ stream carries. Per RFC
+// 9250 section 4.2, a DoQ stream carries exactly one query and is framed by
+// the QUIC stream itself (the client signals "end of message" by closing
+// its write side), unlike DNS-over-TCP there is no length prefix on the
+// wire. The response is written back unframed too, and the stream is closed
+// to signal its end.
+func (s *DoQServer) handleStream(stream quic.Stream, from net.IP) {
+	defer stream.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(stream, maxDoQMessageSize))
+	if err != nil {
+		return
+	}
+
+	q := new(dns.Msg)
+	if err := q.Unpack(raw); err != nil {
+		s.config.Logger.Warn("invalid doq query", zap.Error(err))
+		return
+	}
+
+	qCtx := handler.NewContext(q, from)
+	rw := &doqResponseWriter{stream: stream}
+	s.config.ServerHandler.ServeDNS(stream.Context(), qCtx, rw)
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// doqResponseWriter adapts utils.ResponseWriter to a quic.Stream. It writes
+// the packed DNS message as-is: no length prefix, per RFC 9250.
+type doqResponseWriter struct {
+	stream quic.Stream
+}
+
+func (d *doqResponseWriter) Write(m *dns.Msg) (int, error) {
+	raw, err := m.Pack()
+	if err != nil {
+		return 0, err
+	}
+	return d.stream.Write(raw)
+}
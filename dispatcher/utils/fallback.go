@@ -0,0 +1,257 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/dispatcher/handler"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// FallbackMode controls how FallbackECS dispatches a query to its primary
+// and secondary ExecutableCmdSequence.
+type FallbackMode string
+
+const (
+	// FallbackModeStandard runs primary first and only falls back to
+	// secondary on error or a response the acceptable hook rejects (nil,
+	// SERVFAIL, REFUSED, or an answer inside RejectIPs).
+	FallbackModeStandard FallbackMode = "standard"
+	// FallbackModeRace starts primary and secondary at the same time and
+	// uses whichever returns an acceptable response first.
+	FallbackModeRace FallbackMode = "race"
+	// FallbackModePrimaryWithHeadStart starts primary immediately and only
+	// starts secondary after HeadStart has elapsed without an acceptable
+	// primary response, Happy-Eyeballs style.
+	FallbackModePrimaryWithHeadStart FallbackMode = "primary_with_head_start"
+)
+
+// FallbackConfig is the config of FallbackECS.
+type FallbackConfig struct {
+	// Primary is the primary ExecutableCmdSequence.
+	Primary []interface{} `yaml:"primary"`
+	// Secondary is the fallback/secondary ExecutableCmdSequence.
+	Secondary []interface{} `yaml:"secondary"`
+
+	// Mode selects the dispatch strategy. Empty defaults to FallbackModeStandard.
+	Mode FallbackMode `yaml:"mode"`
+	// HeadStart is the delay, in milliseconds, before secondary is started
+	// when Mode is FallbackModePrimaryWithHeadStart.
+	HeadStart int `yaml:"head_start"`
+
+	// RejectIPs, when set, makes a response unacceptable if any of its
+	// A/AAAA answers fall inside one of these CIDRs (e.g. known
+	// poisoned-response ranges from a GFW-style injector): it loses a
+	// race/head-start, and in standard mode primary falls back to secondary.
+	RejectIPs []string `yaml:"reject_ip"`
+}
+
+// FallbackECS is an ExecutableCmd that runs its primary and secondary
+// ExecutableCmdSequence according to its configured FallbackMode.
+type FallbackECS struct {
+	primary   *ExecutableCmdSequence
+	secondary *ExecutableCmdSequence
+
+	mode       FallbackMode
+	headStart  time.Duration
+	acceptable func(r *dns.Msg) bool
+}
+
+// ParseFallbackECS inits a FallbackECS from c.
+func ParseFallbackECS(c *FallbackConfig) (*FallbackECS, error) {
+	primary, err := ParseExecutableCmdSequence(c.Primary)
+	if err != nil {
+		return nil, fmt.Errorf("invalid primary sequence: %w", err)
+	}
+	secondary, err := ParseExecutableCmdSequence(c.Secondary)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secondary sequence: %w", err)
+	}
+
+	mode := c.Mode
+	if len(mode) == 0 {
+		mode = FallbackModeStandard
+	}
+	switch mode {
+	case FallbackModeStandard, FallbackModeRace, FallbackModePrimaryWithHeadStart:
+	default:
+		return nil, fmt.Errorf("unknown fallback mode %s", mode)
+	}
+
+	acceptable := responseAcceptable
+	if len(c.RejectIPs) > 0 {
+		nets := make([]*net.IPNet, 0, len(c.RejectIPs))
+		for _, s := range c.RejectIPs {
+			_, ipNet, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid reject_ip %s: %w", s, err)
+			}
+			nets = append(nets, ipNet)
+		}
+		acceptable = ipSetAcceptable(nets)
+	}
+
+	return &FallbackECS{
+		primary:    primary,
+		secondary:  secondary,
+		mode:       mode,
+		headStart:  time.Duration(c.HeadStart) * time.Millisecond,
+		acceptable: acceptable,
+	}, nil
+}
+
+// Exec implements ExecutableCmd.
+func (f *FallbackECS) Exec(ctx context.Context, qCtx *handler.Context, logger *zap.Logger) (err error) {
+	switch f.mode {
+	case FallbackModeRace:
+		return f.race(ctx, qCtx, logger, 0)
+	case FallbackModePrimaryWithHeadStart:
+		return f.race(ctx, qCtx, logger, f.headStart)
+	default:
+		return f.standard(ctx, qCtx, logger)
+	}
+}
+
+// standard is the sequential behavior: try primary, fall back to secondary
+// on error or a response f.acceptable rejects.
+func (f *FallbackECS) standard(ctx context.Context, qCtx *handler.Context, logger *zap.Logger) error {
+	err := WalkExecutableCmd(ctx, qCtx, logger, f.primary)
+	if err == nil && f.acceptable(qCtx.R()) {
+		return nil
+	}
+	if err != nil {
+		logger.Warn("primary sequence failed, falling back to secondary", qCtx.InfoField(), zap.Error(err))
+	}
+	return WalkExecutableCmd(ctx, qCtx, logger, f.secondary)
+}
+
+type raceResult struct {
+	qCtx *handler.Context
+	err  error
+}
+
+// race starts primary immediately and starts secondary after secondaryDelay
+// (0 for pure racing), cancels the loser once a winner is decided, and
+// merges the winning qCtx back into qCtx.
+func (f *FallbackECS) race(ctx context.Context, qCtx *handler.Context, logger *zap.Logger, secondaryDelay time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resChan := make(chan *raceResult, 2)
+
+	run := func(name string, cmd *ExecutableCmdSequence) {
+		start := time.Now()
+		clonedQCtx := qCtx.Copy()
+		err := WalkExecutableCmd(ctx, clonedQCtx, logger, cmd)
+		ObservePluginMetrics("fallback_"+name, time.Since(start).Seconds())
+		// clonedQCtx is never merged back into qCtx if it loses the race, so
+		// it's the only reference left that will ever run its plugins'
+		// deferred work (e.g. a cache write-back). Run it here, on a detached
+		// context so a winner elsewhere cancelling ctx can't cut it short.
+		if deferErr := clonedQCtx.ExecDefer(context.Background()); deferErr != nil {
+			logger.Warn("fallback: deferred exec failed", qCtx.InfoField(), zap.String("branch", name), zap.Error(deferErr))
+		}
+		resChan <- &raceResult{qCtx: clonedQCtx, err: err}
+	}
+
+	go run("primary", f.primary)
+	if secondaryDelay > 0 {
+		go func() {
+			select {
+			case <-time.After(secondaryDelay):
+				run("secondary", f.secondary)
+			case <-ctx.Done():
+			}
+		}()
+	} else {
+		go run("secondary", f.secondary)
+	}
+
+	var lastErr error
+	var fallbackRes *raceResult
+	for i := 0; i < 2; i++ {
+		select {
+		case res := <-resChan:
+			if res.err == nil && f.acceptable(res.qCtx.R()) {
+				qCtx.SetResponse(res.qCtx.R(), res.qCtx.Status())
+				return nil
+			}
+			if res.err != nil {
+				lastErr = res.err
+				continue
+			}
+			// Neither branch produced an acceptable response (e.g. both
+			// SERVFAIL): remember the response, same as standard() always
+			// returning secondary's result even when it's not acceptable,
+			// so the client gets a real answer instead of being dropped.
+			fallbackRes = res
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if fallbackRes != nil {
+		qCtx.SetResponse(fallbackRes.qCtx.R(), fallbackRes.qCtx.Status())
+		return nil
+	}
+	return lastErr
+}
+
+// responseAcceptable reports whether r is a well-formed response that should
+// "win" a race: not nil, and not SERVFAIL/REFUSED.
+func responseAcceptable(r *dns.Msg) bool {
+	if r == nil {
+		return false
+	}
+	if r.Rcode == dns.RcodeServerFailure || r.Rcode == dns.RcodeRefused {
+		return false
+	}
+	return true
+}
+
+// ipSetAcceptable is a response_acceptable hook that rejects responses whose
+// A/AAAA answers fall inside any of the given IP sets, e.g. to reject
+// poisoned responses from a GFW-style injector.
+func ipSetAcceptable(poisoned []*net.IPNet) func(r *dns.Msg) bool {
+	return func(r *dns.Msg) bool {
+		if !responseAcceptable(r) {
+			return false
+		}
+		for _, rr := range r.Answer {
+			var ip net.IP
+			switch v := rr.(type) {
+			case *dns.A:
+				ip = v.A
+			case *dns.AAAA:
+				ip = v.AAAA
+			default:
+				continue
+			}
+			for _, ipNet := range poisoned {
+				if ipNet.Contains(ip) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+}
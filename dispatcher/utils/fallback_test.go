@@ -0,0 +1,200 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/dispatcher/handler"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// stubPlugin is a handler.ExecutablePlugin used to drive FallbackECS.race in
+// tests: it first registers a deferred callback that bumps deferRan (so a
+// branch cancelled mid-delay still has deferred work to flush), then after
+// waiting delay it either returns err, or sets qCtx's response to rcode.
+// execed and deferRan let a test assert which branches actually ran.
+type stubPlugin struct {
+	delay    time.Duration
+	rcode    int
+	err      error
+	execed   *int32
+	deferRan *int32
+}
+
+func (s *stubPlugin) Exec(ctx context.Context, qCtx *handler.Context) error {
+	if s.deferRan != nil {
+		dr := s.deferRan
+		qCtx.DeferExec(func(context.Context) error {
+			atomic.AddInt32(dr, 1)
+			return nil
+		})
+	}
+	if s.delay > 0 {
+		select {
+		case <-time.After(s.delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if s.execed != nil {
+		atomic.AddInt32(s.execed, 1)
+	}
+	if s.err != nil {
+		return s.err
+	}
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	r.Rcode = s.rcode
+	qCtx.SetResponse(r, handler.ContextStatusResponded)
+	return nil
+}
+
+func stubSequence(p *stubPlugin) *ExecutableCmdSequence {
+	return NewExecutableCmdSequence([]*ExecutableCmdNode{NewExecutableCmdNode("stub", p)})
+}
+
+func newTestQCtx() *handler.Context {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
+	return handler.NewContext(q, net.ParseIP("127.0.0.1"))
+}
+
+func TestFallbackECS_Race_FastWinnerWins(t *testing.T) {
+	var primaryRan, secondaryRan int32
+	f := &FallbackECS{
+		primary:    stubSequence(&stubPlugin{delay: 5 * time.Millisecond, rcode: dns.RcodeSuccess, execed: &primaryRan}),
+		secondary:  stubSequence(&stubPlugin{delay: 50 * time.Millisecond, rcode: dns.RcodeSuccess, execed: &secondaryRan}),
+		mode:       FallbackModeRace,
+		acceptable: responseAcceptable,
+	}
+
+	qCtx := newTestQCtx()
+	err := f.race(context.Background(), qCtx, zap.NewNop(), 0)
+	if err != nil {
+		t.Fatalf("race() returned err: %v", err)
+	}
+	if qCtx.R() == nil || qCtx.R().Rcode != dns.RcodeSuccess {
+		t.Fatalf("expected a successful response, got %+v", qCtx.R())
+	}
+	if atomic.LoadInt32(&primaryRan) != 1 {
+		t.Errorf("primary should have run")
+	}
+}
+
+func TestFallbackECS_Race_BothUnacceptable_MergesFallbackResponse(t *testing.T) {
+	primary := &stubPlugin{rcode: dns.RcodeServerFailure}
+	secondary := &stubPlugin{rcode: dns.RcodeServerFailure}
+	f := &FallbackECS{
+		primary:    stubSequence(primary),
+		secondary:  stubSequence(secondary),
+		mode:       FallbackModeRace,
+		acceptable: responseAcceptable,
+	}
+
+	qCtx := newTestQCtx()
+	err := f.race(context.Background(), qCtx, zap.NewNop(), 0)
+	if err != nil {
+		t.Fatalf("race() returned err: %v", err)
+	}
+	// Per standard()'s behavior, the client must get a real (if
+	// unacceptable) response instead of being silently dropped.
+	if qCtx.R() == nil {
+		t.Fatal("expected a merged fallback response, got nil")
+	}
+	if qCtx.R().Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode = %d, want SERVFAIL", qCtx.R().Rcode)
+	}
+}
+
+func TestFallbackECS_Race_LoserDeferredExecStillRuns(t *testing.T) {
+	var primaryDeferRan, secondaryDeferRan int32
+	f := &FallbackECS{
+		primary:    stubSequence(&stubPlugin{delay: 5 * time.Millisecond, rcode: dns.RcodeSuccess, deferRan: &primaryDeferRan}),
+		secondary:  stubSequence(&stubPlugin{delay: 50 * time.Millisecond, rcode: dns.RcodeSuccess, deferRan: &secondaryDeferRan}),
+		mode:       FallbackModeRace,
+		acceptable: responseAcceptable,
+	}
+
+	qCtx := newTestQCtx()
+	if err := f.race(context.Background(), qCtx, zap.NewNop(), 0); err != nil {
+		t.Fatalf("race() returned err: %v", err)
+	}
+
+	// The winner (primary)'s deferred work is expected to have run.
+	deadline := time.After(time.Second)
+	for atomic.LoadInt32(&primaryDeferRan) == 0 || atomic.LoadInt32(&secondaryDeferRan) == 0 {
+		select {
+		case <-deadline:
+			t.Fatalf("timed out waiting for deferred exec: primary=%d secondary=%d",
+				atomic.LoadInt32(&primaryDeferRan), atomic.LoadInt32(&secondaryDeferRan))
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// Both branches' deferred work must run, not just the winner's -
+	// nothing merges the loser's qCtx back, so run() is the loser's only
+	// chance to flush cache write-back or similar deferred plugins.
+	if atomic.LoadInt32(&secondaryDeferRan) != 1 {
+		t.Errorf("secondary (the race loser) should still have its deferred exec run")
+	}
+}
+
+func TestFallbackECS_PrimaryWithHeadStart_SecondaryNotStartedIfPrimaryWinsEarly(t *testing.T) {
+	var secondaryRan int32
+	f := &FallbackECS{
+		primary:    stubSequence(&stubPlugin{rcode: dns.RcodeSuccess}),
+		secondary:  stubSequence(&stubPlugin{execed: &secondaryRan, rcode: dns.RcodeSuccess}),
+		mode:       FallbackModePrimaryWithHeadStart,
+		headStart:  50 * time.Millisecond,
+		acceptable: responseAcceptable,
+	}
+
+	qCtx := newTestQCtx()
+	err := f.race(context.Background(), qCtx, zap.NewNop(), f.headStart)
+	if err != nil {
+		t.Fatalf("race() returned err: %v", err)
+	}
+	if qCtx.R() == nil || qCtx.R().Rcode != dns.RcodeSuccess {
+		t.Fatalf("expected primary's response, got %+v", qCtx.R())
+	}
+	if atomic.LoadInt32(&secondaryRan) != 0 {
+		t.Errorf("secondary should never have started: primary answered within the head start")
+	}
+}
+
+func TestFallbackECS_Race_ErrorOnlyReturnedWhenNoResponseAtAll(t *testing.T) {
+	f := &FallbackECS{
+		primary:    stubSequence(&stubPlugin{err: errors.New("primary boom")}),
+		secondary:  stubSequence(&stubPlugin{err: errors.New("secondary boom")}),
+		mode:       FallbackModeRace,
+		acceptable: responseAcceptable,
+	}
+
+	qCtx := newTestQCtx()
+	err := f.race(context.Background(), qCtx, zap.NewNop(), 0)
+	if err == nil {
+		t.Fatal("expected an error when neither branch produced a response")
+	}
+}
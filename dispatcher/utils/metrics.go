@@ -0,0 +1,181 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package utils
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "mosdns"
+
+// pluginMetricsMu guards pluginMetricsInstance.
+var pluginMetricsMu sync.RWMutex
+
+// pluginMetricsInstance is the *Metrics instance plugins that can't have a
+// Registerer threaded through their Args (fallback, hosts, ...) report to.
+// Those plugins are built from the config tree by handler.RegInitFunc before
+// DefaultServerHandler - and the Metrics it owns - exist, so there's no
+// constructor argument to pass a *Metrics through; SetGlobalMetrics is the
+// handoff point instead, called once DefaultServerHandler has built it.
+var pluginMetricsInstance *Metrics
+
+// SetGlobalMetrics installs m as the instance pluginMetrics() returns. It is
+// safe for concurrent use: once a non-nil *Metrics has been installed, later
+// calls (e.g. from a second DefaultServerHandler) leave it in place. It
+// registers nothing itself; collectors are registered by NewMetrics, which
+// panics if its Registerer already holds them.
+func SetGlobalMetrics(m *Metrics) {
+	pluginMetricsMu.Lock()
+	defer pluginMetricsMu.Unlock()
+	if pluginMetricsInstance == nil {
+		pluginMetricsInstance = m
+	}
+}
+
+// pluginMetrics returns the *Metrics installed by SetGlobalMetrics, or nil
+// if none has been installed yet (metrics disabled, or called before the
+// first DefaultServerHandler is built).
+func pluginMetrics() *Metrics {
+	pluginMetricsMu.RLock()
+	defer pluginMetricsMu.RUnlock()
+	return pluginMetricsInstance
+}
+
+// ObservePluginMetrics records how long the plugin/node identified by tag
+// spent executing, using the process-wide instance installed via
+// SetGlobalMetrics. It's a no-op if metrics are disabled.
+func ObservePluginMetrics(tag string, seconds float64) {
+	pluginMetrics().ObservePluginExec(tag, seconds)
+}
+
+// Metrics holds the Prometheus collectors shared by DefaultServerHandler and
+// the plugins it dispatches to. A nil *Metrics is valid and every method on
+// it is a no-op, so callers don't need to guard every call site with a nil
+// check.
+type Metrics struct {
+	QueriesTotal       prometheus.Counter
+	ResponseRcodeTotal *prometheus.CounterVec
+	InFlightQueries    prometheus.Gauge
+	ActiveClients      prometheus.Gauge
+	QueueWaitTime      prometheus.Histogram
+	ClientRejectsTotal *prometheus.CounterVec
+	EntryDuration      prometheus.Histogram
+	ExecutableCmdTime  *prometheus.HistogramVec
+}
+
+// NewMetrics creates and registers the mosdns metrics with reg. If reg is
+// nil, NewMetrics returns nil and all instrumentation becomes a no-op.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	if reg == nil {
+		return nil
+	}
+
+	f := promauto.With(reg)
+	return &Metrics{
+		QueriesTotal: f.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "queries_total",
+			Help:      "Total number of queries received by the server handler.",
+		}),
+		ResponseRcodeTotal: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "response_rcode_total",
+			Help:      "Total number of responses sent, by rcode.",
+		}, []string{"rcode"}),
+		InFlightQueries: f.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "in_flight_queries",
+			Help:      "Number of queries currently being processed.",
+		}),
+		ActiveClients: f.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_clients",
+			Help:      "Number of unique clients currently tracked by the client query limiter.",
+		}),
+		QueueWaitTime: f.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "concurrent_limit_queue_wait_seconds",
+			Help:      "Time a query spent waiting for a ConcurrentLimiter token.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		ClientRejectsTotal: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "client_rejected_total",
+			Help:      "Total number of queries refused because a per-client limit was exceeded, labeled by MaskClientKey group (the plain client IP when ClientGroupPrefixV4/V6 masking is disabled).",
+		}, []string{"client"}),
+		EntryDuration: f.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "entry_duration_seconds",
+			Help:      "Time spent walking the entry ExecutableCmdSequence.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		ExecutableCmdTime: f.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "plugin_exec_duration_seconds",
+			Help:      "Time spent executing a pipeline node or plugin, labeled by its tag (or Go type for untagged nodes).",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"tag"}),
+	}
+}
+
+// ObservePluginExec records how long a plugin identified by tag spent
+// executing. It is safe to call on a nil *Metrics.
+func (m *Metrics) ObservePluginExec(tag string, seconds float64) {
+	if m == nil {
+		return
+	}
+	m.ExecutableCmdTime.WithLabelValues(tag).Observe(seconds)
+}
+
+// IncActiveClients increments the unique active client gauge. Safe to call on a nil *Metrics.
+func (m *Metrics) IncActiveClients() {
+	if m == nil {
+		return
+	}
+	m.ActiveClients.Inc()
+}
+
+// DecActiveClients decrements the unique active client gauge. Safe to call on a nil *Metrics.
+func (m *Metrics) DecActiveClients() {
+	if m == nil {
+		return
+	}
+	m.ActiveClients.Dec()
+}
+
+// ServeMetrics registers the metrics handler under path (defaulting to
+// "/metrics") on addr and serves it until the process exits. Errors are
+// reported through errChan so the caller can decide how to log/handle them.
+func ServeMetrics(addr, path string, gatherer prometheus.Gatherer) <-chan error {
+	if len(path) == 0 {
+		path = "/metrics"
+	}
+
+	errChan := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	go func() {
+		errChan <- http.ListenAndServe(addr, mux)
+	}()
+	return errChan
+}
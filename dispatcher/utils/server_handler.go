@@ -21,8 +21,12 @@ import (
 	"context"
 	"github.com/IrineSistiana/mosdns/dispatcher/handler"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
+	"net"
+	"strconv"
 	"testing"
+	"time"
 )
 
 type ServerHandler interface {
@@ -40,6 +44,8 @@ type DefaultServerHandler struct {
 
 	limiter       *ConcurrentLimiter  // if it's nil, means no limit.
 	clientLimiter *ClientQueryLimiter // if it's nil, means no limit.
+	clientQPS     *ClientRateLimiter  // if it's nil, means no per-client QPS limit.
+	metrics       *Metrics            // if it's nil, metrics are disabled.
 }
 
 type DefaultServerHandlerConfig struct {
@@ -60,6 +66,35 @@ type DefaultServerHandlerConfig struct {
 	// When calling DefaultServerHandler.ServeDNS(), if a client query exceeds the limit,
 	// an REFUSED response will be returned to client.
 	ConcurrentLimitPreClient int
+
+	// QPSPreClient controls the max queries per second for each client.
+	// If QPSPreClient <= 0, means no limit.
+	// Unlike ConcurrentLimitPreClient, this is a token-bucket rate limit, not a
+	// concurrency limit. It uses the (optionally masked, see ClientGroupPrefixV4/V6)
+	// qCtx.From() as the identification of clients. On exceed, a REFUSED response
+	// is returned, with the TC bit set if ClientQPSSetTC is true, to push abusive
+	// clients onto TCP where the concurrency-based limits above still apply.
+	QPSPreClient   int
+	ClientQPSSetTC bool
+
+	// ClientGroupPrefixV4 and ClientGroupPrefixV6 mask qCtx.From() to the given
+	// CIDR prefix length before using it as the QPSPreClient identification key,
+	// so clients behind a shared CGNAT/carrier-grade range are rate limited as a
+	// group instead of individually. <= 0 disables masking for that family.
+	ClientGroupPrefixV4 int
+	ClientGroupPrefixV6 int
+
+	// MetricsRegisterer, if not nil, makes DefaultServerHandler register a set of
+	// Prometheus collectors (query counts, in-flight gauge, queue wait time, etc.)
+	// with it. If it's nil, metrics are disabled.
+	MetricsRegisterer prometheus.Registerer
+
+	// MetricsHTTPAddr, if not empty, starts an HTTP server listening on this address
+	// that exposes the registered metrics on MetricsHTTPPath (default "/metrics").
+	// MetricsRegisterer must also be a prometheus.Gatherer (e.g. prometheus.NewRegistry())
+	// for this to work.
+	MetricsHTTPAddr string
+	MetricsHTTPPath string
 }
 
 // NewDefaultServerHandler:
@@ -67,12 +102,32 @@ type DefaultServerHandlerConfig struct {
 func NewDefaultServerHandler(config *DefaultServerHandlerConfig) *DefaultServerHandler {
 	h := &DefaultServerHandler{config: config}
 
+	h.metrics = NewMetrics(config.MetricsRegisterer)
+	SetGlobalMetrics(h.metrics)
+
 	if config.ConcurrentLimit > 0 {
 		h.limiter = NewConcurrentLimiter(config.ConcurrentLimit)
 	}
 
 	if config.ConcurrentLimitPreClient > 0 {
 		h.clientLimiter = NewClientQueryLimiter(config.ConcurrentLimitPreClient)
+		h.clientLimiter.metrics = h.metrics
+	}
+
+	if config.QPSPreClient > 0 {
+		h.clientQPS = NewClientRateLimiter(float64(config.QPSPreClient), config.QPSPreClient, 0)
+	}
+
+	if h.metrics != nil && len(config.MetricsHTTPAddr) > 0 {
+		if gatherer, ok := config.MetricsRegisterer.(prometheus.Gatherer); ok {
+			go func() {
+				if err := <-ServeMetrics(config.MetricsHTTPAddr, config.MetricsHTTPPath, gatherer); err != nil {
+					config.Logger.Warn("metrics http server exited", zap.Error(err))
+				}
+			}()
+		} else {
+			config.Logger.Warn("MetricsHTTPAddr is set but MetricsRegisterer is not a prometheus.Gatherer, metrics endpoint disabled")
+		}
 	}
 	return h
 }
@@ -82,29 +137,67 @@ func NewDefaultServerHandler(config *DefaultServerHandlerConfig) *DefaultServerH
 // If concurrentLimit is reached, the query will block and wait available token until ctx is done.
 func (h *DefaultServerHandler) ServeDNS(ctx context.Context, qCtx *handler.Context, w ResponseWriter) {
 	write := func(r *dns.Msg) {
+		if h.metrics != nil && r != nil {
+			h.metrics.ResponseRcodeTotal.WithLabelValues(strconv.Itoa(r.Rcode)).Inc()
+		}
 		if _, err := w.Write(r); err != nil {
 			h.config.Logger.Warn("write response", qCtx.InfoField(), zap.Error(err))
 		}
 	}
 
-	if h.clientLimiter != nil {
-		addr := qCtx.From()
-		if addr != nil {
-			key := addr.String()
-			if h.clientLimiter.Acquire(key) != true {
-				r := new(dns.Msg)
-				r.SetReply(qCtx.Q())
-				r.Rcode = dns.RcodeRefused
-				write(r)
-				return
+	clientKey := ""
+	var clientIP net.IP
+	if addr := qCtx.From(); addr != nil {
+		clientKey = addr.String()
+		clientIP = addr
+	}
+	if h.metrics != nil {
+		h.metrics.QueriesTotal.Inc()
+		h.metrics.InFlightQueries.Inc()
+		defer h.metrics.InFlightQueries.Dec()
+	}
+
+	if h.clientLimiter != nil && len(clientKey) > 0 {
+		if h.clientLimiter.Acquire(clientKey) != true {
+			if h.metrics != nil {
+				// Label by the same MaskClientKey group the QPS path uses,
+				// so ClientGroupPrefixV4/V6 bound this label's cardinality;
+				// with masking disabled the group is the raw client IP.
+				h.metrics.ClientRejectsTotal.WithLabelValues(MaskClientKey(clientIP, h.config.ClientGroupPrefixV4, h.config.ClientGroupPrefixV6)).Inc()
+			}
+			r := new(dns.Msg)
+			r.SetReply(qCtx.Q())
+			r.Rcode = dns.RcodeRefused
+			write(r)
+			return
+		}
+		defer h.clientLimiter.Done(clientKey)
+	}
+
+	if h.clientQPS != nil && clientIP != nil {
+		groupKey := MaskClientKey(clientIP, h.config.ClientGroupPrefixV4, h.config.ClientGroupPrefixV6)
+		if !h.clientQPS.Allow(groupKey) {
+			if h.metrics != nil {
+				h.metrics.ClientRejectsTotal.WithLabelValues(groupKey).Inc()
+			}
+			r := new(dns.Msg)
+			r.SetReply(qCtx.Q())
+			r.Rcode = dns.RcodeRefused
+			if h.config.ClientQPSSetTC {
+				r.Truncated = true
 			}
-			defer h.clientLimiter.Done(key)
+			write(r)
+			return
 		}
 	}
 
 	if h.limiter != nil {
+		waitStart := time.Now()
 		select {
 		case <-h.limiter.Wait():
+			if h.metrics != nil {
+				h.metrics.QueueWaitTime.Observe(time.Since(waitStart).Seconds())
+			}
 			defer h.limiter.Done()
 		case <-ctx.Done():
 			// silently drop this query
@@ -135,7 +228,11 @@ func (h *DefaultServerHandler) ServeDNS(ctx context.Context, qCtx *handler.Conte
 }
 
 func (h *DefaultServerHandler) execEntry(ctx context.Context, qCtx *handler.Context) error {
+	start := time.Now()
 	err := WalkExecutableCmd(ctx, qCtx, h.config.Logger, h.config.Entry)
+	if h.metrics != nil {
+		h.metrics.EntryDuration.Observe(time.Since(start).Seconds())
+	}
 	if err != nil {
 		return err
 	}
@@ -168,6 +265,7 @@ func (d *DummyServerHandler) ServeDNS(_ context.Context, qCtx *handler.Context,
 type ClientQueryLimiter struct {
 	maxQueries int
 	m          *ConcurrentMap
+	metrics    *Metrics
 }
 
 func NewClientQueryLimiter(maxQueries int) *ClientQueryLimiter {
@@ -185,6 +283,8 @@ func (l *ClientQueryLimiter) acquireTestAndSet(v interface{}, ok bool) (newV int
 	n := 0
 	if ok {
 		n = v.(int)
+	} else {
+		l.metrics.IncActiveClients() // first time we see this client
 	}
 	if n >= l.maxQueries {
 		return nil, false, false
@@ -203,6 +303,7 @@ func (l *ClientQueryLimiter) doneTestAndSet(v interface{}, ok bool) (newV interf
 		panic("ClientQueryLimiter doneTestAndSet: value becomes negative")
 	}
 	if n == 0 {
+		l.metrics.DecActiveClients()
 		return nil, true, true
 	}
 	return n, true, true
@@ -0,0 +1,105 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/dispatcher/handler"
+	"go.uber.org/zap"
+)
+
+// ExecutableCmd is a single node in an entry's config pipeline: anything
+// WalkExecutableCmd can run. ExecutableCmdSequence, FallbackECS and a plain
+// plugin reference (ExecutableCmdNode) all implement it.
+type ExecutableCmd interface {
+	Exec(ctx context.Context, qCtx *handler.Context, logger *zap.Logger) (err error)
+}
+
+// tagged is implemented by ExecutableCmd nodes that have a meaningful label
+// for metrics/logging, e.g. a plugin's configured tag.
+type tagged interface {
+	Tag() string
+}
+
+// WalkExecutableCmd runs cmd and records how long it took in
+// Metrics.ExecutableCmdTime, labeled by cmd's tag if it has one. Every
+// caller that wants a node in the pipeline to show up in per-node timing
+// (the entry sequence, fallback's primary/secondary, a single plugin
+// reference) goes through this function instead of calling cmd.Exec
+// directly. Some plugins (hosts, fallback) also report their own timings
+// through ObservePluginMetrics.
+func WalkExecutableCmd(ctx context.Context, qCtx *handler.Context, logger *zap.Logger, cmd ExecutableCmd) error {
+	start := time.Now()
+	err := cmd.Exec(ctx, qCtx, logger)
+	ObservePluginMetrics(cmdTag(cmd), time.Since(start).Seconds())
+	return err
+}
+
+func cmdTag(cmd ExecutableCmd) string {
+	if t, ok := cmd.(tagged); ok {
+		return t.Tag()
+	}
+	return fmt.Sprintf("%T", cmd)
+}
+
+// ExecutableCmdNode is a single step of an ExecutableCmdSequence: a resolved
+// reference to a registered handler.ExecutablePlugin.
+type ExecutableCmdNode struct {
+	tag    string
+	plugin handler.ExecutablePlugin
+}
+
+// NewExecutableCmdNode wraps plugin so it can be used as an ExecutableCmd
+// node inside an ExecutableCmdSequence. tag is the plugin's configured tag,
+// used to label its metrics.
+func NewExecutableCmdNode(tag string, plugin handler.ExecutablePlugin) *ExecutableCmdNode {
+	return &ExecutableCmdNode{tag: tag, plugin: plugin}
+}
+
+func (n *ExecutableCmdNode) Tag() string { return n.tag }
+
+func (n *ExecutableCmdNode) Exec(ctx context.Context, qCtx *handler.Context, _ *zap.Logger) error {
+	return n.plugin.Exec(ctx, qCtx)
+}
+
+// ExecutableCmdSequence is an ordered list of ExecutableCmdNode, walked
+// front-to-back and stopped early once qCtx already has a response.
+type ExecutableCmdSequence struct {
+	nodes []*ExecutableCmdNode
+}
+
+// NewExecutableCmdSequence builds an ExecutableCmdSequence out of its
+// already-resolved nodes.
+func NewExecutableCmdSequence(nodes []*ExecutableCmdNode) *ExecutableCmdSequence {
+	return &ExecutableCmdSequence{nodes: nodes}
+}
+
+func (seq *ExecutableCmdSequence) Exec(ctx context.Context, qCtx *handler.Context, logger *zap.Logger) error {
+	for _, node := range seq.nodes {
+		if err := WalkExecutableCmd(ctx, qCtx, logger, node); err != nil {
+			return err
+		}
+		if qCtx.Status() == handler.ContextStatusResponded {
+			return nil
+		}
+	}
+	return nil
+}